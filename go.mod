@@ -9,6 +9,7 @@ require (
 	github.com/rs/zerolog v1.34.0
 	go.mau.fi/util v0.8.8-0.20250616080919-85a7d4c089ac
 	go.mau.fi/zeroconfig v0.1.3
+	golang.org/x/sys v0.33.0
 	google.golang.org/api v0.237.0
 )
 
@@ -61,7 +62,6 @@ require (
 	golang.org/x/net v0.41.0 // indirect
 	golang.org/x/oauth2 v0.30.0 // indirect
 	golang.org/x/sync v0.15.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 	golang.org/x/text v0.26.0 // indirect
 	golang.org/x/time v0.12.0 // indirect
 	google.golang.org/appengine/v2 v2.0.6 // indirect
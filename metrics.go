@@ -0,0 +1,136 @@
+// gomuks/push - An FCM push gateway for gomuks android.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// otherOwnerLabel is used for owners that didn't fit within the tracked owner limit.
+const otherOwnerLabel = "other"
+const ownerHashLength = 12
+
+var ErrMissingOwnerSalt = errors.New("per-owner metrics require a salt")
+var ErrInvalidMaxOwners = errors.New("maximum number of tracked owners must be at least 1")
+
+// Metrics keeps track of push request counters and serves them in the Prometheus text format.
+type Metrics struct {
+	lock          sync.Mutex
+	requests      map[int]uint64
+	ownerPushes   map[string]uint64
+	trackedOwners map[string]struct{}
+
+	perOwner  bool
+	ownerSalt []byte
+	maxOwners int
+}
+
+// NewMetrics creates a new metrics collector. If perOwner is true, successful pushes are also counted per
+// owner, labeled with a salted hash of the owner. At most maxOwners distinct owners are tracked; the rest
+// are grouped under a single "other" label.
+func NewMetrics(perOwner bool, ownerSalt string, maxOwners int) (*Metrics, error) {
+	if perOwner && ownerSalt == "" {
+		return nil, ErrMissingOwnerSalt
+	} else if perOwner && maxOwners < 1 {
+		return nil, ErrInvalidMaxOwners
+	}
+	return &Metrics{
+		requests:      make(map[int]uint64),
+		ownerPushes:   make(map[string]uint64),
+		trackedOwners: make(map[string]struct{}),
+
+		perOwner:  perOwner,
+		ownerSalt: []byte(ownerSalt),
+		maxOwners: maxOwners,
+	}, nil
+}
+
+// HashOwner returns a stable short hash of the given owner using the configured salt.
+func (m *Metrics) HashOwner(owner string) string {
+	mac := hmac.New(sha256.New, m.ownerSalt)
+	mac.Write([]byte(owner))
+	return hex.EncodeToString(mac.Sum(nil))[:ownerHashLength]
+}
+
+// RecordPush counts a push request. The owner is only counted for successful pushes, so that
+// requests which fail FCM can't claim tracked owner slots.
+func (m *Metrics) RecordPush(owner string, status int) {
+	if m == nil {
+		return
+	}
+	var ownerLabel string
+	if m.perOwner && owner != "" && status == http.StatusOK {
+		ownerLabel = m.HashOwner(owner)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.requests[status]++
+	if ownerLabel == "" {
+		return
+	}
+	if _, tracked := m.trackedOwners[ownerLabel]; !tracked {
+		if len(m.trackedOwners) >= m.maxOwners {
+			ownerLabel = otherOwnerLabel
+		} else {
+			m.trackedOwners[ownerLabel] = struct{}{}
+		}
+	}
+	m.ownerPushes[ownerLabel]++
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var buf strings.Builder
+	m.lock.Lock()
+	buf.WriteString("# HELP gomuks_push_requests_total Number of push requests handled, by response status.\n")
+	buf.WriteString("# TYPE gomuks_push_requests_total counter\n")
+	statuses := make([]int, 0, len(m.requests))
+	for status := range m.requests {
+		statuses = append(statuses, status)
+	}
+	slices.Sort(statuses)
+	for _, status := range statuses {
+		_, _ = fmt.Fprintf(&buf, "gomuks_push_requests_total{status=\"%d\"} %d\n", status, m.requests[status])
+	}
+	if m.perOwner {
+		buf.WriteString("# HELP gomuks_push_owner_pushes_total Number of successful pushes, by hashed owner.\n")
+		buf.WriteString("# TYPE gomuks_push_owner_pushes_total counter\n")
+		owners := make([]string, 0, len(m.ownerPushes))
+		for owner := range m.ownerPushes {
+			owners = append(owners, owner)
+		}
+		slices.Sort(owners)
+		for _, owner := range owners {
+			_, _ = fmt.Fprintf(&buf, "gomuks_push_owner_pushes_total{owner=\"%s\"} %d\n", owner, m.ownerPushes[owner])
+		}
+		buf.WriteString("# HELP gomuks_push_tracked_owners Number of distinct owners with their own metric labels.\n")
+		buf.WriteString("# TYPE gomuks_push_tracked_owners gauge\n")
+		buf.WriteString("gomuks_push_tracked_owners " + strconv.Itoa(len(m.trackedOwners)) + "\n")
+	}
+	m.lock.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write([]byte(buf.String()))
+}
@@ -0,0 +1,169 @@
+// gomuks/push - An FCM push gateway for gomuks android.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNewMetrics_InvalidConfig(t *testing.T) {
+	if _, err := NewMetrics(true, "", 10); !errors.Is(err, ErrMissingOwnerSalt) {
+		t.Errorf("expected ErrMissingOwnerSalt, got %v", err)
+	}
+	for _, maxOwners := range []int{0, -1} {
+		if _, err := NewMetrics(true, "salt", maxOwners); !errors.Is(err, ErrInvalidMaxOwners) {
+			t.Errorf("expected ErrInvalidMaxOwners for %d, got %v", maxOwners, err)
+		}
+	}
+	if _, err := NewMetrics(false, "", 0); err != nil {
+		t.Errorf("expected owner settings to be ignored without per-owner m, got %v", err)
+	}
+}
+
+func TestMetrics_HashOwner(t *testing.T) {
+	m := mustNewMetrics(t, true, "salt", 10)
+	hash := m.HashOwner("@user:example.com")
+	if len(hash) != ownerHashLength {
+		t.Errorf("expected hash of length %d, got %q", ownerHashLength, hash)
+	}
+	if strings.Contains(hash, "user") {
+		t.Errorf("expected hash not to contain the owner, got %q", hash)
+	}
+	if again := m.HashOwner("@user:example.com"); again != hash {
+		t.Errorf("expected hash to be stable, got %q and %q", hash, again)
+	}
+	if other := m.HashOwner("@other:example.com"); other == hash {
+		t.Errorf("expected different owners to have different hashes, got %q", other)
+	}
+	otherSalt := mustNewMetrics(t, true, "other salt", 10)
+	if salted := otherSalt.HashOwner("@user:example.com"); salted == hash {
+		t.Errorf("expected hash to change with the salt, got %q", salted)
+	}
+}
+
+func TestMetrics_RecordPush_MaxOwners(t *testing.T) {
+	m := mustNewMetrics(t, true, "salt", 2)
+	for _, owner := range []string{"@a:example.com", "@b:example.com", "@c:example.com", "@d:example.com", "@a:example.com"} {
+		m.RecordPush(owner, http.StatusOK)
+	}
+	if len(m.trackedOwners) != 2 {
+		t.Errorf("expected 2 tracked owners, got %d", len(m.trackedOwners))
+	}
+	if got := m.ownerPushes[m.HashOwner("@a:example.com")]; got != 2 {
+		t.Errorf("expected 2 pushes for first owner, got %d", got)
+	}
+	if got := m.ownerPushes[otherOwnerLabel]; got != 2 {
+		t.Errorf("expected 2 pushes for other owners, got %d", got)
+	}
+	if got := m.requests[http.StatusOK]; got != 5 {
+		t.Errorf("expected 5 successful requests, got %d", got)
+	}
+}
+
+func TestMetrics_RecordPush_FailuresDontClaimOwners(t *testing.T) {
+	m := mustNewMetrics(t, true, "salt", 1)
+	for i, status := range []int{http.StatusBadRequest, http.StatusNotFound, http.StatusInternalServerError} {
+		m.RecordPush(fmt.Sprintf("@spam%d:example.com", i), status)
+	}
+	if len(m.trackedOwners) != 0 || len(m.ownerPushes) != 0 {
+		t.Errorf("expected failed pushes not to be counted per owner, got %v", m.ownerPushes)
+	}
+	m.RecordPush("@user:example.com", http.StatusOK)
+	if got := m.ownerPushes[m.HashOwner("@user:example.com")]; got != 1 {
+		t.Errorf("expected successful owner to get a tracked slot, got %v", m.ownerPushes)
+	}
+	if got := m.requests[http.StatusNotFound]; got != 1 {
+		t.Errorf("expected failed request to be counted in the total, got %d", got)
+	}
+}
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	m := mustNewMetrics(t, true, "salt", 10)
+	m.RecordPush("@b:example.com", http.StatusOK)
+	m.RecordPush("@a:example.com", http.StatusOK)
+	m.RecordPush("@a:example.com", http.StatusOK)
+	m.RecordPush("@c:example.com", http.StatusNotFound)
+	m.RecordPush("", http.StatusBadRequest)
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rec.Code)
+	}
+	if contentType := rec.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", contentType)
+	}
+	body := rec.Body.String()
+	if !strings.HasSuffix(body, "\n") {
+		t.Error("expected output to end with a newline")
+	}
+	var requestLines, ownerLines []string
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		name, _, ok := strings.Cut(line, " ")
+		if !ok {
+			t.Errorf("malformed metric line %q", line)
+		}
+		switch {
+		case strings.HasPrefix(name, "gomuks_push_requests_total{"):
+			requestLines = append(requestLines, line)
+		case strings.HasPrefix(name, "gomuks_push_owner_pushes_total{"):
+			ownerLines = append(ownerLines, line)
+		case name == "gomuks_push_tracked_owners":
+			if line != "gomuks_push_tracked_owners 2" {
+				t.Errorf("unexpected tracked owners line %q", line)
+			}
+		default:
+			t.Errorf("unexpected metric line %q", line)
+		}
+	}
+	expectedRequests := []string{
+		`gomuks_push_requests_total{status="200"} 3`,
+		`gomuks_push_requests_total{status="400"} 1`,
+		`gomuks_push_requests_total{status="404"} 1`,
+	}
+	if !slices.Equal(requestLines, expectedRequests) {
+		t.Errorf("expected request lines %q, got %q", expectedRequests, requestLines)
+	}
+	if len(ownerLines) != 2 || !slices.IsSorted(ownerLines) {
+		t.Errorf("expected 2 sorted owner lines, got %q", ownerLines)
+	}
+	expectedOwner := fmt.Sprintf(`gomuks_push_owner_pushes_total{owner="%s"} 2`, m.HashOwner("@a:example.com"))
+	if !slices.Contains(ownerLines, expectedOwner) {
+		t.Errorf("expected owner lines to contain %q, got %q", expectedOwner, ownerLines)
+	}
+	if strings.Contains(body, "example.com") {
+		t.Error("expected owners not to appear in the output")
+	}
+}
+
+func mustNewMetrics(t *testing.T, perOwner bool, salt string, maxOwners int) *Metrics {
+	t.Helper()
+	m, err := NewMetrics(perOwner, salt, maxOwners)
+	if err != nil {
+		t.Fatalf("failed to create m: %v", err)
+	}
+	return m
+}
@@ -0,0 +1,423 @@
+// gomuks/push - An FCM push gateway for gomuks android.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rs/zerolog"
+	"go.mau.fi/zeroconfig"
+)
+
+const otlpBatchSize = 512
+const otlpFlushInterval = 5 * time.Second
+const otlpQueueSize = 8192
+const otlpSendTimeout = 10 * time.Second
+const otlpReportInterval = 1 * time.Minute
+
+// otlpCloseTimeout is the total time Close spends flushing queued events before dropping the rest.
+const otlpCloseTimeout = 3 * time.Second
+
+// WriterTypeOTLP is a zeroconfig writer type that ships logs to the OpenTelemetry collector
+// configured with the OTEL_EXPORTER_OTLP_LOGS_* or OTEL_EXPORTER_OTLP_* environment variables.
+const WriterTypeOTLP zeroconfig.WriterType = "otlp"
+
+// otlpLogWriter is the writer created for WriterTypeOTLP, kept so that it can be flushed on shutdown.
+var otlpLogWriter *OTLPLogWriter
+
+func init() {
+	zeroconfig.RegisterWriter(WriterTypeOTLP, func(_ *zeroconfig.WriterConfig) (io.Writer, error) {
+		serviceName := os.Getenv("OTEL_SERVICE_NAME")
+		if serviceName == "" {
+			serviceName = "gomuks-push"
+		}
+		headers := os.Getenv("OTEL_EXPORTER_OTLP_HEADERS") + "," + os.Getenv("OTEL_EXPORTER_OTLP_LOGS_HEADERS")
+		writer, err := NewOTLPLogWriter(otlpLogsEndpoint(), headers, serviceName)
+		if err != nil {
+			return nil, err
+		}
+		otlpLogWriter = writer
+		return writer, nil
+	})
+}
+
+// otlpLogsEndpoint returns the OTLP logs endpoint from the environment. As per the OTLP exporter spec,
+// the signal-specific variable is used as-is, while the generic one is a base URL for all signals.
+func otlpLogsEndpoint() string {
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT"); endpoint != "" {
+		return endpoint
+	} else if baseEndpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); baseEndpoint != "" {
+		return strings.TrimSuffix(baseEndpoint, "/") + "/v1/logs"
+	}
+	return ""
+}
+
+// OTLPLogWriter is a zerolog.LevelWriter that ships JSON log events to an
+// OpenTelemetry collector using the OTLP/HTTP JSON encoding.
+type OTLPLogWriter struct {
+	endpoint string
+	headers  http.Header
+	resource otlpResource
+	client   *http.Client
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	queue     chan *otlpLogRecord
+	stop      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+
+	droppedEvents atomic.Uint64
+	failedBatches atomic.Uint64
+}
+
+var _ zerolog.LevelWriter = (*OTLPLogWriter)(nil)
+
+// NewOTLPLogWriter creates a log writer for the given OTLP logs endpoint
+// (e.g. http://localhost:4318/v1/logs) and starts its background sender.
+func NewOTLPLogWriter(endpoint, headers, serviceName string) (*OTLPLogWriter, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("OTLP endpoint not set")
+	} else if parsedEndpoint, err := url.Parse(endpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse OTLP endpoint: %w", err)
+	} else if parsedEndpoint.Scheme != "http" && parsedEndpoint.Scheme != "https" {
+		return nil, fmt.Errorf("OTLP endpoint %q must use http or https", endpoint)
+	} else if parsedEndpoint.Host == "" {
+		return nil, fmt.Errorf("OTLP endpoint %q is missing a host", endpoint)
+	}
+	parsedHeaders, err := parseOTLPHeaders(headers)
+	if err != nil {
+		return nil, err
+	}
+	w := &OTLPLogWriter{
+		endpoint: endpoint,
+		headers:  parsedHeaders,
+		resource: otlpResource{Attributes: []otlpKeyValue{{
+			Key:   "service.name",
+			Value: otlpAnyValue{StringValue: &serviceName},
+		}}},
+		client: &http.Client{Timeout: otlpSendTimeout},
+		queue:  make(chan *otlpLogRecord, otlpQueueSize),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	go w.loop()
+	return w, nil
+}
+
+// parseOTLPHeaders parses headers in the format used by OTEL_EXPORTER_OTLP_HEADERS,
+// i.e. comma-separated key=value pairs with URL-encoded values.
+func parseOTLPHeaders(raw string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, pair := range strings.Split(raw, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			return nil, fmt.Errorf("invalid OTLP header %q", pair)
+		}
+		decodedValue, err := url.PathUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTLP header value for %q: %w", key, err)
+		}
+		headers.Set(strings.TrimSpace(key), decodedValue)
+	}
+	return headers, nil
+}
+
+func (w *OTLPLogWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(zerolog.NoLevel, p)
+}
+
+func (w *OTLPLogWriter) WriteLevel(level zerolog.Level, p []byte) (int, error) {
+	record, err := parseOTLPLogRecord(level, p)
+	if err != nil {
+		return 0, err
+	}
+	select {
+	case w.queue <- record:
+	default:
+		// The collector isn't keeping up, drop the event rather than blocking the caller.
+		w.droppedEvents.Add(1)
+	}
+	return len(p), nil
+}
+
+// Close flushes queued log events and stops the background sender.
+// Events that can't be sent within otlpCloseTimeout are dropped.
+func (w *OTLPLogWriter) Close() error {
+	w.closeOnce.Do(func() {
+		close(w.stop)
+		time.AfterFunc(otlpCloseTimeout, w.cancel)
+	})
+	<-w.done
+	w.cancel()
+	return nil
+}
+
+func (w *OTLPLogWriter) loop() {
+	defer close(w.done)
+	ticker := time.NewTicker(otlpFlushInterval)
+	defer ticker.Stop()
+	reportTicker := time.NewTicker(otlpReportInterval)
+	defer reportTicker.Stop()
+	batch := make([]*otlpLogRecord, 0, otlpBatchSize)
+	for {
+		select {
+		case record := <-w.queue:
+			batch = append(batch, record)
+			if len(batch) >= otlpBatchSize {
+				w.send(w.ctx, batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				w.send(w.ctx, batch)
+				batch = batch[:0]
+			}
+		case <-reportTicker.C:
+			w.reportFailures()
+		case <-w.stop:
+			w.flush(batch)
+			w.reportFailures()
+			return
+		}
+	}
+}
+
+func (w *OTLPLogWriter) flush(batch []*otlpLogRecord) {
+	ctx := w.ctx
+	for len(w.queue) > 0 && ctx.Err() == nil {
+		batch = append(batch, <-w.queue)
+		if len(batch) >= otlpBatchSize {
+			w.send(ctx, batch)
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 && ctx.Err() == nil {
+		w.send(ctx, batch)
+		batch = batch[:0]
+	}
+	w.droppedEvents.Add(uint64(len(batch) + len(w.queue)))
+}
+
+// reportFailures writes dropped event and failed batch counts to stderr.
+// Errors can't be logged normally without looping back into this writer.
+func (w *OTLPLogWriter) reportFailures() {
+	dropped := w.droppedEvents.Swap(0)
+	failed := w.failedBatches.Swap(0)
+	if dropped > 0 || failed > 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "OTLP log export: %d events dropped and %d batches failed since last report\n", dropped, failed)
+	}
+}
+
+func (w *OTLPLogWriter) send(ctx context.Context, batch []*otlpLogRecord) {
+	if err := w.doSend(ctx, batch); err != nil {
+		w.failedBatches.Add(1)
+		w.droppedEvents.Add(uint64(len(batch)))
+	}
+}
+
+func (w *OTLPLogWriter) doSend(ctx context.Context, batch []*otlpLogRecord) error {
+	body, err := json.Marshal(&otlpLogsRequest{ResourceLogs: []otlpResourceLogs{{
+		Resource: w.resource,
+		ScopeLogs: []otlpScopeLogs{{
+			Scope:      otlpScope{Name: "push.gomuks.app"},
+			LogRecords: batch,
+		}},
+	}}})
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, otlpSendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, values := range w.headers {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func parseOTLPLogRecord(level zerolog.Level, p []byte) (*otlpLogRecord, error) {
+	dec := json.NewDecoder(bytes.NewReader(p))
+	dec.UseNumber()
+	var evt map[string]any
+	if err := dec.Decode(&evt); err != nil {
+		return nil, fmt.Errorf("failed to parse log event: %w", err)
+	}
+	now := time.Now()
+	record := &otlpLogRecord{
+		TimeUnixNano:         strconv.FormatInt(now.UnixNano(), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(now.UnixNano(), 10),
+	}
+	if rawTime, ok := evt[zerolog.TimestampFieldName].(string); ok {
+		if ts, err := time.Parse(time.RFC3339Nano, rawTime); err == nil {
+			record.TimeUnixNano = strconv.FormatInt(ts.UnixNano(), 10)
+		}
+		delete(evt, zerolog.TimestampFieldName)
+	}
+	if rawLevel, ok := evt[zerolog.LevelFieldName].(string); ok {
+		if parsedLevel, err := zerolog.ParseLevel(rawLevel); err == nil && level == zerolog.NoLevel {
+			level = parsedLevel
+		}
+		delete(evt, zerolog.LevelFieldName)
+	}
+	record.SeverityNumber, record.SeverityText = otlpSeverity(level)
+	if msg, ok := evt[zerolog.MessageFieldName].(string); ok {
+		record.Body = &otlpAnyValue{StringValue: &msg}
+		delete(evt, zerolog.MessageFieldName)
+	}
+	record.Attributes = otlpKeyValues(evt)
+	return record, nil
+}
+
+func otlpSeverity(level zerolog.Level) (int, string) {
+	switch level {
+	case zerolog.TraceLevel:
+		return 1, "TRACE"
+	case zerolog.DebugLevel:
+		return 5, "DEBUG"
+	case zerolog.InfoLevel:
+		return 9, "INFO"
+	case zerolog.WarnLevel:
+		return 13, "WARN"
+	case zerolog.ErrorLevel:
+		return 17, "ERROR"
+	case zerolog.FatalLevel:
+		return 21, "FATAL"
+	case zerolog.PanicLevel:
+		return 24, "FATAL4"
+	default:
+		return 0, ""
+	}
+}
+
+type otlpLogsRequest struct {
+	ResourceLogs []otlpResourceLogs `json:"resourceLogs"`
+}
+
+type otlpResourceLogs struct {
+	Resource  otlpResource    `json:"resource"`
+	ScopeLogs []otlpScopeLogs `json:"scopeLogs"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeLogs struct {
+	Scope      otlpScope        `json:"scope"`
+	LogRecords []*otlpLogRecord `json:"logRecords"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string         `json:"timeUnixNano"`
+	ObservedTimeUnixNano string         `json:"observedTimeUnixNano"`
+	SeverityNumber       int            `json:"severityNumber,omitempty"`
+	SeverityText         string         `json:"severityText,omitempty"`
+	Body                 *otlpAnyValue  `json:"body,omitempty"`
+	Attributes           []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string         `json:"stringValue,omitempty"`
+	BoolValue   *bool           `json:"boolValue,omitempty"`
+	IntValue    *string         `json:"intValue,omitempty"`
+	DoubleValue *float64        `json:"doubleValue,omitempty"`
+	ArrayValue  *otlpArrayValue `json:"arrayValue,omitempty"`
+	KvlistValue *otlpKvlist     `json:"kvlistValue,omitempty"`
+}
+
+type otlpArrayValue struct {
+	Values []otlpAnyValue `json:"values"`
+}
+
+type otlpKvlist struct {
+	Values []otlpKeyValue `json:"values"`
+}
+
+func otlpKeyValues(fields map[string]any) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(fields))
+	for key, value := range fields {
+		kvs = append(kvs, otlpKeyValue{Key: key, Value: otlpValue(value)})
+	}
+	return kvs
+}
+
+func otlpValue(value any) otlpAnyValue {
+	switch typedValue := value.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &typedValue}
+	case bool:
+		return otlpAnyValue{BoolValue: &typedValue}
+	case json.Number:
+		if _, err := typedValue.Int64(); err == nil {
+			intValue := typedValue.String()
+			return otlpAnyValue{IntValue: &intValue}
+		}
+		floatValue, _ := typedValue.Float64()
+		return otlpAnyValue{DoubleValue: &floatValue}
+	case []any:
+		values := make([]otlpAnyValue, len(typedValue))
+		for i, item := range typedValue {
+			values[i] = otlpValue(item)
+		}
+		return otlpAnyValue{ArrayValue: &otlpArrayValue{Values: values}}
+	case map[string]any:
+		return otlpAnyValue{KvlistValue: &otlpKvlist{Values: otlpKeyValues(typedValue)}}
+	default:
+		// null values
+		emptyValue := ""
+		return otlpAnyValue{StringValue: &emptyValue}
+	}
+}
@@ -0,0 +1,224 @@
+// gomuks/push - An FCM push gateway for gomuks android.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+func TestParseOTLPHeaders(t *testing.T) {
+	headers, err := parseOTLPHeaders("api-key=secret, Authorization = Bearer%20token%3D,,")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := headers.Get("Api-Key"); got != "secret" {
+		t.Errorf("expected api-key to be %q, got %q", "secret", got)
+	}
+	if got := headers.Get("Authorization"); got != "Bearer token=" {
+		t.Errorf("expected authorization to be %q, got %q", "Bearer token=", got)
+	}
+
+	headers, err = parseOTLPHeaders("")
+	if err != nil || len(headers) != 0 {
+		t.Errorf("expected no headers and no error for empty input, got %v, %v", headers, err)
+	}
+
+	for _, invalid := range []string{"novalue", "=value", "key=%zz"} {
+		if _, err = parseOTLPHeaders(invalid); err == nil {
+			t.Errorf("expected error for %q", invalid)
+		}
+	}
+}
+
+func TestNewOTLPLogWriter_InvalidEndpoint(t *testing.T) {
+	for _, endpoint := range []string{"", "otel-collector:4318/v1/logs", "localhost:4318", "ftp://collector/v1/logs", "http:///v1/logs"} {
+		if writer, err := NewOTLPLogWriter(endpoint, "", "test-service"); err == nil {
+			_ = writer.Close()
+			t.Errorf("expected error for endpoint %q", endpoint)
+		}
+	}
+}
+
+func TestOTLPLogsEndpoint(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	if got := otlpLogsEndpoint(); got != "" {
+		t.Errorf("expected no endpoint, got %q", got)
+	}
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "http://collector:4318/")
+	if got := otlpLogsEndpoint(); got != "http://collector:4318/v1/logs" {
+		t.Errorf("expected generic endpoint with logs path, got %q", got)
+	}
+	t.Setenv("OTEL_EXPORTER_OTLP_LOGS_ENDPOINT", "http://logs-collector:4318/custom")
+	if got := otlpLogsEndpoint(); got != "http://logs-collector:4318/custom" {
+		t.Errorf("expected logs endpoint to be used as-is, got %q", got)
+	}
+}
+
+func attributesByKey(record *otlpLogRecord) map[string]otlpAnyValue {
+	attrs := make(map[string]otlpAnyValue, len(record.Attributes))
+	for _, kv := range record.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestParseOTLPLogRecord(t *testing.T) {
+	record, err := parseOTLPLogRecord(zerolog.NoLevel, []byte(`{"level":"warn","time":"2024-01-02T03:04:05.123Z","message":"hello","count":5,"ratio":1.5,"ok":true}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if record.SeverityNumber != 13 || record.SeverityText != "WARN" {
+		t.Errorf("expected WARN severity, got %d %q", record.SeverityNumber, record.SeverityText)
+	}
+	expectedTime := time.Date(2024, 1, 2, 3, 4, 5, 123000000, time.UTC).UnixNano()
+	if record.TimeUnixNano != strconv.FormatInt(expectedTime, 10) {
+		t.Errorf("expected time %d, got %s", expectedTime, record.TimeUnixNano)
+	}
+	if record.Body == nil || record.Body.StringValue == nil || *record.Body.StringValue != "hello" {
+		t.Errorf("expected body to be the message, got %+v", record.Body)
+	}
+	attrs := attributesByKey(record)
+	if len(attrs) != 3 {
+		t.Errorf("expected level, time and message to be removed from attributes, got %+v", attrs)
+	}
+	if count := attrs["count"]; count.IntValue == nil || *count.IntValue != "5" || count.DoubleValue != nil {
+		t.Errorf("expected count to be an int, got %+v", count)
+	}
+	if ratio := attrs["ratio"]; ratio.DoubleValue == nil || *ratio.DoubleValue != 1.5 || ratio.IntValue != nil {
+		t.Errorf("expected ratio to be a double, got %+v", ratio)
+	}
+	if ok := attrs["ok"]; ok.BoolValue == nil || !*ok.BoolValue {
+		t.Errorf("expected ok to be a bool, got %+v", ok)
+	}
+}
+
+func TestParseOTLPLogRecord_ExplicitLevel(t *testing.T) {
+	record, err := parseOTLPLogRecord(zerolog.ErrorLevel, []byte(`{"level":"info","time":"invalid"}`))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if record.SeverityNumber != 17 || record.SeverityText != "ERROR" {
+		t.Errorf("expected ERROR severity, got %d %q", record.SeverityNumber, record.SeverityText)
+	}
+	if record.TimeUnixNano == "" {
+		t.Error("expected unparseable time to fall back to the current time")
+	}
+	if record.Body != nil {
+		t.Errorf("expected no body without a message, got %+v", record.Body)
+	}
+	if _, err = parseOTLPLogRecord(zerolog.InfoLevel, []byte(`not json`)); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestOTLPLogWriter_RoundTrip(t *testing.T) {
+	type receivedRequest struct {
+		header http.Header
+		body   []byte
+	}
+	requests := make(chan receivedRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- receivedRequest{header: r.Header, body: body}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	writer, err := NewOTLPLogWriter(server.URL+"/v1/logs", "api-key=secret", "test-service")
+	if err != nil {
+		t.Fatalf("failed to create writer: %v", err)
+	}
+	if _, err = writer.WriteLevel(zerolog.InfoLevel, []byte(`{"level":"info","message":"hello","owner":"@user:example.com"}`)); err != nil {
+		t.Fatalf("failed to write event: %v", err)
+	}
+	if err = writer.Close(); err != nil {
+		t.Fatalf("failed to close writer: %v", err)
+	}
+
+	var req receivedRequest
+	select {
+	case req = <-requests:
+	default:
+		t.Fatal("expected a request to be sent on close")
+	}
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("expected JSON content type, got %q", got)
+	}
+	if got := req.header.Get("Api-Key"); got != "secret" {
+		t.Errorf("expected custom header to be sent, got %q", got)
+	}
+	var payload struct {
+		ResourceLogs []struct {
+			Resource struct {
+				Attributes []struct {
+					Key   string `json:"key"`
+					Value struct {
+						StringValue string `json:"stringValue"`
+					} `json:"value"`
+				} `json:"attributes"`
+			} `json:"resource"`
+			ScopeLogs []struct {
+				Scope struct {
+					Name string `json:"name"`
+				} `json:"scope"`
+				LogRecords []struct {
+					SeverityNumber int    `json:"severityNumber"`
+					SeverityText   string `json:"severityText"`
+					Body           struct {
+						StringValue string `json:"stringValue"`
+					} `json:"body"`
+					Attributes []struct {
+						Key string `json:"key"`
+					} `json:"attributes"`
+				} `json:"logRecords"`
+			} `json:"scopeLogs"`
+		} `json:"resourceLogs"`
+	}
+	if err = json.Unmarshal(req.body, &payload); err != nil {
+		t.Fatalf("failed to parse request body: %v", err)
+	}
+	if len(payload.ResourceLogs) != 1 || len(payload.ResourceLogs[0].ScopeLogs) != 1 {
+		t.Fatalf("expected one resource and scope, got %s", req.body)
+	}
+	resource := payload.ResourceLogs[0].Resource
+	if len(resource.Attributes) != 1 || resource.Attributes[0].Key != "service.name" || resource.Attributes[0].Value.StringValue != "test-service" {
+		t.Errorf("unexpected resource attributes: %s", req.body)
+	}
+	scopeLogs := payload.ResourceLogs[0].ScopeLogs[0]
+	if scopeLogs.Scope.Name != "push.gomuks.app" {
+		t.Errorf("unexpected scope name %q", scopeLogs.Scope.Name)
+	}
+	if len(scopeLogs.LogRecords) != 1 {
+		t.Fatalf("expected one log record, got %s", req.body)
+	}
+	record := scopeLogs.LogRecords[0]
+	if record.SeverityNumber != 9 || record.SeverityText != "INFO" || record.Body.StringValue != "hello" {
+		t.Errorf("unexpected log record: %s", req.body)
+	}
+	if len(record.Attributes) != 1 || record.Attributes[0].Key != "owner" {
+		t.Errorf("unexpected log record attributes: %s", req.body)
+	}
+}
@@ -0,0 +1,65 @@
+// gomuks/push - An FCM push gateway for gomuks android.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const appDirName = "gomuks-push"
+
+// dataDir returns the directory where the gateway looks for its data files,
+// such as the default FCM credentials file. It can be overridden with DATA_DIR.
+func dataDir() string {
+	if dir := os.Getenv("DATA_DIR"); dir != "" {
+		return dir
+	}
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(programDataDir(), appDirName)
+	case "darwin":
+		return filepath.Join("/Library/Application Support", appDirName)
+	default:
+		return filepath.Join("/var/lib", appDirName)
+	}
+}
+
+// defaultLogFile returns the platform-appropriate path for the JSON log file.
+func defaultLogFile() string {
+	switch runtime.GOOS {
+	case "windows":
+		return filepath.Join(programDataDir(), appDirName, "logs", "gomuks-push.log")
+	case "darwin":
+		return filepath.Join("/Library/Logs", "gomuks-push.log")
+	default:
+		return filepath.Join("/var/log", "gomuks-push.log")
+	}
+}
+
+func programDataDir() string {
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		return dir
+	}
+	return `C:\ProgramData`
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -23,9 +23,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"strconv"
 	"syscall"
 	"time"
 
@@ -44,6 +47,7 @@ import (
 
 var fcmPackageName = os.Getenv("FCM_PACKAGE_NAME")
 var fcmClient *messaging.Client
+var metrics *Metrics
 
 func init() {
 	if _, hasPort := os.LookupEnv("PORT"); !hasPort {
@@ -51,29 +55,89 @@ func init() {
 	}
 }
 
-func main() {
-	log := exerrors.Must((&zeroconfig.Config{
+func setupLogging() (*zerolog.Logger, func(), error) {
+	logConfig := &zeroconfig.Config{
 		Writers: []zeroconfig.WriterConfig{{
 			Type:     zeroconfig.WriterTypeStdout,
 			Format:   zeroconfig.LogFormatPrettyColored,
 			MinLevel: ptr.Ptr(zerolog.InfoLevel),
-		}, {
+		}},
+		MinLevel: ptr.Ptr(zerolog.TraceLevel),
+	}
+	logFile, hasLogFile := os.LookupEnv("LOG_FILE")
+	if !hasLogFile {
+		logFile = defaultLogFile()
+	}
+	if logFile != "" {
+		logConfig.Writers = append(logConfig.Writers, zeroconfig.WriterConfig{
 			Type:   zeroconfig.WriterTypeFile,
 			Format: zeroconfig.LogFormatJSON,
 			FileConfig: zeroconfig.FileConfig{
-				Filename:   "/var/log/gomuks-push.log",
+				Filename:   logFile,
 				MaxSize:    100 * 1024,
 				MaxAge:     7,
 				MaxBackups: 10,
 			},
-		}},
-		MinLevel: ptr.Ptr(zerolog.TraceLevel),
-	}).Compile())
+		})
+	}
+	if otlpLogsEndpoint() != "" {
+		logConfig.Writers = append(logConfig.Writers, zeroconfig.WriterConfig{
+			Type:   WriterTypeOTLP,
+			Format: zeroconfig.LogFormatJSON,
+		})
+	}
+	log, err := logConfig.Compile()
+	if err != nil {
+		return nil, nil, err
+	}
+	return log, func() {
+		if otlpLogWriter != nil {
+			_ = otlpLogWriter.Close()
+		}
+	}, nil
+}
+
+// serverShutdownTimeout is how long the HTTP servers are given to finish in-flight requests on shutdown.
+const serverShutdownTimeout = 5 * time.Second
+
+func main() {
+	runService()
+}
+
+// runUntilSignal runs the push gateway until an interrupt or termination signal is received.
+// On Windows, SIGTERM is also delivered for console close, logoff and system shutdown events.
+func runUntilSignal() {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	err := run(ctx, nil)
+	cancel()
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Push gateway failed:", err)
+		os.Exit(1)
+	}
+}
+
+// run starts the push gateway and blocks until the given context is canceled or a server fails.
+// If ready is non-nil, it's closed once the listeners are bound. Errors are logged before returning,
+// except if the logger itself couldn't be set up.
+func run(stopCtx context.Context, ready chan<- struct{}) error {
+	log, closeLogs, err := setupLogging()
+	if err != nil {
+		return fmt.Errorf("failed to set up logging: %w", err)
+	}
+	defer closeLogs()
 	exzerolog.SetupDefaults(log)
+	err = runServers(stopCtx, log, ready)
+	if err != nil {
+		log.Err(err).Msg("Push gateway failed")
+	}
+	return err
+}
+
+func runServers(stopCtx context.Context, log *zerolog.Logger, ready chan<- struct{}) error {
 	mux := http.NewServeMux()
 	mux.HandleFunc("POST /_gomuks/push/fcm", handlePushProxy)
 	mux.HandleFunc("GET /{$}", handleIndex)
-	server := http.Server{
+	server := &http.Server{
 		Addr: fmt.Sprintf("%s:%s", os.Getenv("HOST"), os.Getenv("PORT")),
 		Handler: exhttp.ApplyMiddleware(
 			mux,
@@ -82,21 +146,73 @@ func main() {
 		),
 	}
 	ctx := log.WithContext(context.Background())
-	app := exerrors.Must(firebase.NewApp(ctx, nil, option.WithCredentialsFile(os.Getenv("FCM_CREDENTIALS_FILE"))))
-	fcmClient = exerrors.Must(app.Messaging(ctx))
-	go func() {
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		<-c
-		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		exerrors.PanicIfNotNil(server.Shutdown(ctx))
-		cancel()
-	}()
-	log.Info().Str("listen_address", server.Addr).Msg("Starting server")
-	err := server.ListenAndServe()
-	if err != nil && !errors.Is(err, http.ErrServerClosed) {
-		panic(err)
+	credentialsFile, hasCredentialsFile := os.LookupEnv("FCM_CREDENTIALS_FILE")
+	if defaultCredentialsFile := filepath.Join(dataDir(), "fcm-credentials.json"); !hasCredentialsFile && fileExists(defaultCredentialsFile) {
+		credentialsFile = defaultCredentialsFile
+	}
+	app, err := firebase.NewApp(ctx, nil, option.WithCredentialsFile(credentialsFile))
+	if err != nil {
+		return fmt.Errorf("failed to initialize firebase: %w", err)
+	}
+	fcmClient, err = app.Messaging(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to initialize FCM client: %w", err)
+	}
+	servers := []*http.Server{server}
+	metricsAddr := os.Getenv("METRICS_LISTEN_ADDRESS")
+	perOwnerMetrics := os.Getenv("METRICS_PER_OWNER") == "true"
+	if metricsAddr == "" && perOwnerMetrics {
+		log.Warn().Msg("METRICS_PER_OWNER is set, but metrics are disabled because METRICS_LISTEN_ADDRESS is not set")
+	} else if metricsAddr != "" {
+		maxOwners := 1000
+		if rawMaxOwners := os.Getenv("METRICS_MAX_OWNERS"); rawMaxOwners != "" {
+			maxOwners, err = strconv.Atoi(rawMaxOwners)
+			if err != nil {
+				return fmt.Errorf("invalid METRICS_MAX_OWNERS: %w", err)
+			}
+		}
+		metrics, err = NewMetrics(perOwnerMetrics, os.Getenv("METRICS_OWNER_SALT"), maxOwners)
+		if err != nil {
+			return fmt.Errorf("invalid metrics config: %w", err)
+		}
+		servers = append(servers, &http.Server{Addr: metricsAddr, Handler: metrics})
+	}
+	listeners := make([]net.Listener, len(servers))
+	for i, srv := range servers {
+		listeners[i], err = net.Listen("tcp", srv.Addr)
+		if err != nil {
+			for _, listener := range listeners[:i] {
+				_ = listener.Close()
+			}
+			return fmt.Errorf("failed to listen on %s: %w", srv.Addr, err)
+		}
+	}
+	serveErrors := make(chan error, len(servers))
+	for i, srv := range servers {
+		log.Info().Str("listen_address", srv.Addr).Msg("Starting server")
+		go func() {
+			err := srv.Serve(listeners[i])
+			if err != nil && !errors.Is(err, http.ErrServerClosed) {
+				serveErrors <- fmt.Errorf("server on %s failed: %w", srv.Addr, err)
+			}
+		}()
+	}
+	if ready != nil {
+		close(ready)
+	}
+	select {
+	case <-stopCtx.Done():
+		log.Info().Msg("Shutting down server")
+	case err = <-serveErrors:
+	}
+	shutdownCtx, cancel := context.WithTimeout(ctx, serverShutdownTimeout)
+	defer cancel()
+	for _, srv := range servers {
+		if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to shut down server on %s: %w", srv.Addr, shutdownErr))
+		}
 	}
+	return err
 }
 
 //go:embed index.html
@@ -139,16 +255,17 @@ const maxContentLength = 4096
 
 func handlePushProxy(w http.ResponseWriter, r *http.Request) {
 	var req PushRequest
+	var status int
 	if r.URL.Path != "/_gomuks/push/fcm" {
-		w.WriteHeader(http.StatusNotFound)
+		status = http.StatusNotFound
 	} else if r.ContentLength > maxContentLength {
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		status = http.StatusRequestEntityTooLarge
 	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		status = http.StatusBadRequest
 	} else if base64.StdEncoding.EncodedLen(len(req.Payload)) > maxPayloadLength {
-		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		status = http.StatusRequestEntityTooLarge
 	} else if len(req.Owner) == 0 || len(req.Owner) > 255 {
-		w.WriteHeader(http.StatusBadRequest)
+		status = http.StatusBadRequest
 	} else if resp, err := fcmClient.Send(r.Context(), req.ToFCM()); err != nil {
 		hlog.FromRequest(r).
 			Err(err).
@@ -157,9 +274,9 @@ func handlePushProxy(w http.ResponseWriter, r *http.Request) {
 			Msg("Failed to send FCM request")
 		// TODO can errors be checked properly?
 		if err.Error() == "Requested entity was not found." || err.Error() == "SenderId mismatch" {
-			w.WriteHeader(http.StatusNotFound)
+			status = http.StatusNotFound
 		} else {
-			w.WriteHeader(http.StatusInternalServerError)
+			status = http.StatusInternalServerError
 		}
 	} else {
 		hlog.FromRequest(r).
@@ -168,6 +285,8 @@ func handlePushProxy(w http.ResponseWriter, r *http.Request) {
 			Str("message_id", resp).
 			Str("owner", req.Owner).
 			Msg("Sent FCM request")
-		w.WriteHeader(http.StatusOK)
+		status = http.StatusOK
 	}
+	metrics.RecordPush(req.Owner, status)
+	w.WriteHeader(status)
 }
@@ -0,0 +1,182 @@
+// gomuks/push - An FCM push gateway for gomuks android.
+// Copyright (C) 2024 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"go.mau.fi/util/exerrors"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+const serviceName = "gomuks-push"
+
+// serviceStopWaitHint tells the service manager how long stopping may take:
+// the HTTP server shutdown, the OTLP log flush and some slack.
+const serviceStopWaitHint = serverShutdownTimeout + otlpCloseTimeout + 2*time.Second
+
+func runService() {
+	isService := exerrors.Must(svc.IsWindowsService())
+	if isService {
+		exerrors.PanicIfNotNil(svc.Run(serviceName, &windowsService{}))
+		return
+	}
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "install":
+			err = installService()
+		case "uninstall":
+			err = uninstallService()
+		case "start":
+			err = startService()
+		case "stop":
+			err = stopService()
+		default:
+			err = fmt.Errorf("unknown command %q (expected install, uninstall, start or stop)", os.Args[1])
+		}
+		if err != nil {
+			_, _ = fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+	runUntilSignal()
+}
+
+type windowsService struct{}
+
+func (ws *windowsService) Execute(_ []string, requests <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
+	changes <- svc.Status{State: svc.StartPending}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ready := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, ready)
+	}()
+	select {
+	case <-ready:
+	case <-done:
+		// Startup failed, run has already logged the error.
+		return false, 1
+	}
+	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+	for {
+		select {
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				changes <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				changes <- svc.Status{State: svc.StopPending, WaitHint: uint32(serviceStopWaitHint.Milliseconds())}
+				cancel()
+				if err := <-done; err != nil {
+					return false, 1
+				}
+				return false, 0
+			}
+		case <-done:
+			// One of the servers failed, run has already logged the error.
+			return false, 1
+		}
+	}
+}
+
+func installService() error {
+	exePath, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to get executable path: %w", err)
+	}
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+	if s, err := m.OpenService(serviceName); err == nil {
+		_ = s.Close()
+		return fmt.Errorf("service %s already exists", serviceName)
+	}
+	s, err := m.CreateService(serviceName, exePath, mgr.Config{
+		DisplayName: "gomuks push gateway",
+		Description: "FCM push gateway for gomuks android",
+		StartType:   mgr.StartAutomatic,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to create service: %w", err)
+	}
+	return s.Close()
+}
+
+func uninstallService() error {
+	return withService(func(s *mgr.Service) error {
+		if err := s.Delete(); err != nil {
+			return fmt.Errorf("failed to delete service: %w", err)
+		}
+		return nil
+	})
+}
+
+func startService() error {
+	return withService(func(s *mgr.Service) error {
+		if err := s.Start(); err != nil {
+			return fmt.Errorf("failed to start service: %w", err)
+		}
+		return nil
+	})
+}
+
+func stopService() error {
+	return withService(func(s *mgr.Service) error {
+		status, err := s.Control(svc.Stop)
+		if err != nil {
+			return fmt.Errorf("failed to stop service: %w", err)
+		}
+		deadline := time.Now().Add(serviceStopWaitHint + 5*time.Second)
+		for status.State != svc.Stopped {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("timed out waiting for service to stop")
+			}
+			time.Sleep(300 * time.Millisecond)
+			status, err = s.Query()
+			if err != nil {
+				return fmt.Errorf("failed to query service status: %w", err)
+			}
+		}
+		return nil
+	})
+}
+
+func withService(fn func(s *mgr.Service) error) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to service manager: %w", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return fmt.Errorf("failed to open service: %w", err)
+	}
+	defer s.Close()
+	return fn(s)
+}